@@ -0,0 +1,148 @@
+package wango
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Authentication methods recognized by the HELLO/CHALLENGE/AUTHENTICATE
+// handshake.
+const (
+	AuthMethodAnonymous = "anonymous"
+	AuthMethodTicket    = "ticket"
+	AuthMethodWAMPCRA   = "wampcra"
+)
+
+// ErrAuthFailed is sent to the client when the handshake frames can't be
+// parsed as expected.
+var ErrAuthFailed = errors.New("authentication failed")
+
+// ErrAuthMethodNotSupported is sent to the client when its requested auth
+// method isn't one of the Authenticator's Methods().
+var ErrAuthMethodNotSupported = errors.New("auth method not supported")
+
+// authMsgType distinguishes the handshake frames from the regular v1/v2
+// message codes, since the handshake runs before a connection is handed to
+// either dispatch loop.
+type authMsgType int
+
+const (
+	authMsgChallenge authMsgType = 1
+	authMsgAbort     authMsgType = 2
+)
+
+// Authenticator validates sessions during the HELLO/CHALLENGE/AUTHENTICATE
+// handshake, which runs before WampHandler starts dispatching RPC/pub/sub
+// messages.
+type Authenticator interface {
+	// Methods returns the auth methods this Authenticator supports, e.g.
+	// "ticket", "wampcra", "anonymous".
+	Methods() []string
+	// Authenticate verifies challengeResponse for authid under method and
+	// returns the value to store as conn.extra on success. challenge is the
+	// exact CHALLENGE text sent to the client; for wampcra it is the value
+	// VerifyWAMPCRA needs to recompute the HMAC. It is empty for methods,
+	// like ticket, that don't send a server-generated challenge.
+	Authenticate(method string, authid string, challenge string, challengeResponse string) (extra interface{}, err error)
+}
+
+// SetAuthenticator installs a, requiring every new connection to complete
+// its handshake before RPC/pub/sub messages are dispatched.
+func (server *WS) SetAuthenticator(a Authenticator) {
+	server.authenticator = a
+}
+
+// authenticate runs the HELLO/CHALLENGE/AUTHENTICATE handshake against
+// server.authenticator before the connection is handed to the normal
+// message dispatch loop. It returns the extra value to store on the
+// connection and whether authentication succeeded.
+func (server *WS) authenticate(c *conn) (interface{}, bool) {
+	data, err := c.connection.Receive()
+	if err != nil {
+		return nil, false
+	}
+	_, hello, err := parseMessage(data)
+	if err != nil || len(hello) < 2 {
+		server.abort(c, ErrAuthFailed)
+		return nil, false
+	}
+	authid, _ := hello[0].(string)
+	method, _ := hello[1].(string)
+
+	if !containsString(server.authenticator.Methods(), method) {
+		server.abort(c, ErrAuthMethodNotSupported)
+		return nil, false
+	}
+
+	challenge := ""
+	if method == AuthMethodWAMPCRA {
+		challenge = craChallenge(authid, c.id)
+	}
+	response, _ := createMessage(authMsgChallenge, method, challenge)
+	if err := c.connection.Send(string(response)); err != nil {
+		return nil, false
+	}
+
+	data, err = c.connection.Receive()
+	if err != nil {
+		return nil, false
+	}
+	_, authenticate, err := parseMessage(data)
+	if err != nil || len(authenticate) < 1 {
+		server.abort(c, ErrAuthFailed)
+		return nil, false
+	}
+	challengeResponse, _ := authenticate[0].(string)
+
+	extra, err := server.authenticator.Authenticate(method, authid, challenge, challengeResponse)
+	if err != nil {
+		server.abort(c, err)
+		return nil, false
+	}
+	return extra, true
+}
+
+func (server *WS) abort(c *conn, err error) {
+	response, _ := createMessage(authMsgAbort, createError(err))
+	c.connection.Send(string(response))
+	c.connection.Close()
+}
+
+// craChallenge builds the WAMP-CRA challenge: a JSON object with authid,
+// nonce, timestamp and session, which the client must sign with
+// HMAC-SHA256(secret, challenge) and return base64-encoded.
+func craChallenge(authid, sessionID string) string {
+	challenge, _ := json.Marshal(map[string]interface{}{
+		"authid":    authid,
+		"nonce":     newUUIDv4(),
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"session":   sessionID,
+	})
+	return string(challenge)
+}
+
+// VerifyWAMPCRA reports whether response is the base64-encoded
+// HMAC-SHA256(secret, challenge), as computed by a conforming WAMP-CRA
+// client. Authenticator implementations use this to check a wampcra
+// challengeResponse against the secret looked up for authid.
+func VerifyWAMPCRA(secret, challenge, response string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(challenge))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(response)) == 1
+}
+
+func containsString(items []string, item string) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package wango
+
+import "time"
+
+// defaultSendTimeout is how long conn.send waits for a slow consumer's
+// buffer to free up before disconnecting it, unless overridden by
+// SetSendTimeout.
+const defaultSendTimeout = 5 * time.Second
+
+// defaultSendBufferSize is the per-connection outgoing message buffer size,
+// unless overridden by SetSendBufferSize.
+const defaultSendBufferSize = 16
+
+// SlowConsumerCB is called once, right before a connection is disconnected
+// for failing to drain its send buffer within the configured send timeout.
+// dropped is the number of messages dropped for that connection so far.
+type SlowConsumerCB func(connID string, dropped int)
+
+// SetSendTimeout configures how long a send to a connection's buffer may
+// block before that connection is treated as a slow consumer and dropped.
+func (server *WS) SetSendTimeout(d time.Duration) {
+	server.sendTimeout = d
+}
+
+// SetSendBufferSize configures the per-connection outgoing message buffer
+// size used for connections added after this call.
+func (server *WS) SetSendBufferSize(n int) {
+	server.sendBufferSize = n
+}
+
+// SetSlowConsumerCB installs cb to be notified when a connection is
+// disconnected for being a slow consumer.
+func (server *WS) SetSlowConsumerCB(cb SlowConsumerCB) {
+	server.slowConsumerCB = cb
+}
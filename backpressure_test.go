@@ -0,0 +1,84 @@
+package wango
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type closeTrackingTransport struct {
+	closed int32
+}
+
+func (*closeTrackingTransport) Send(msg string) error    { return nil }
+func (*closeTrackingTransport) Receive() (string, error) { return "", nil }
+func (t *closeTrackingTransport) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	return nil
+}
+
+// TestSlowConsumerDisconnect fills a connection's send buffer with no
+// consumer draining it, and checks that the next send past SetSendTimeout
+// disconnects the connection, increments MessagesDropped and fires
+// SlowConsumerCB exactly once.
+func TestSlowConsumerDisconnect(t *testing.T) {
+	server := New()
+	server.SetSendTimeout(10 * time.Millisecond)
+	server.SetSendBufferSize(1)
+
+	var cbConnID string
+	var cbDropped int
+	cbCalled := make(chan struct{})
+	server.SetSlowConsumerCB(func(connID string, dropped int) {
+		cbConnID = connID
+		cbDropped = dropped
+		close(cbCalled)
+	})
+
+	transport := &closeTrackingTransport{}
+	c := server.addConnection(transport, nil)
+
+	c.send("first") // fills the size-1 buffer; nothing drains it
+
+	done := make(chan struct{})
+	go func() {
+		c.send("second") // should block past sendTimeout, then disconnect
+		close(done)
+	}()
+
+	select {
+	case <-cbCalled:
+	case <-time.After(time.Second):
+		t.Fatal("SlowConsumerCB was never called")
+	}
+	<-done
+
+	if cbConnID != c.id {
+		t.Fatalf("SlowConsumerCB connID = %q, want %q", cbConnID, c.id)
+	}
+	if cbDropped != 1 {
+		t.Fatalf("SlowConsumerCB dropped = %d, want 1", cbDropped)
+	}
+	if atomic.LoadInt32(&transport.closed) != 1 {
+		t.Fatal("expected the slow consumer's transport to be closed")
+	}
+	if got := server.Metrics().MessagesDropped(); got != 1 {
+		t.Fatalf("MessagesDropped() = %d, want 1", got)
+	}
+}
+
+func TestMetricsSubscriptionsPerURI(t *testing.T) {
+	m := newMetrics()
+	m.setSubscriptionCount("com.example.topic", 3)
+	m.setSubscriptionCount("com.example.other", 1)
+
+	got := m.SubscriptionsPerURI()
+	if got["com.example.topic"] != 3 || got["com.example.other"] != 1 {
+		t.Fatalf("SubscriptionsPerURI() = %v", got)
+	}
+
+	m.setSubscriptionCount("com.example.topic", 0)
+	if _, ok := m.SubscriptionsPerURI()["com.example.topic"]; ok {
+		t.Fatal("expected a URI with zero subscribers to be removed from the snapshot")
+	}
+}
@@ -0,0 +1,28 @@
+package wango
+
+import "testing"
+
+func TestMatchURI(t *testing.T) {
+	cases := []struct {
+		name    string
+		pattern string
+		uri     string
+		mode    MatchMode
+		want    bool
+	}{
+		{"exact match", "com.example.topic", "com.example.topic", MatchExact, true},
+		{"exact mismatch on prefix", "com.example", "com.example.topic", MatchExact, false},
+		{"prefix match", "com.example", "com.example.topic", MatchPrefix, true},
+		{"prefix mismatch", "com.other", "com.example.topic", MatchPrefix, false},
+		{"wildcard match", "com.example..onevent", "com.example.widget.onevent", MatchWildcard, true},
+		{"wildcard segment mismatch", "com.example..onevent", "com.example.widget.onstart", MatchWildcard, false},
+		{"wildcard length mismatch", "com.example..onevent", "com.example.onevent", MatchWildcard, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := matchURI(tc.pattern, tc.uri, tc.mode); got != tc.want {
+				t.Fatalf("matchURI(%q, %q, %v) = %v, want %v", tc.pattern, tc.uri, tc.mode, got, tc.want)
+			}
+		})
+	}
+}
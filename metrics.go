@@ -0,0 +1,95 @@
+package wango
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics holds plain counters and gauges for a WS server, read through the
+// accessor methods below. These are bespoke int64/time.Duration values, not
+// prometheus.Counter/Gauge types, and there is no registry or /metrics HTTP
+// handler here — wire the accessors into whatever exposition format the
+// embedding application already uses. All accessors are safe for concurrent
+// use while the server is running.
+type Metrics struct {
+	openConnections  int64
+	messagesSent     int64
+	messagesReceived int64
+	messagesDropped  int64
+	rpcCalls         int64
+	rpcErrors        int64
+
+	subscriptionsLocker sync.RWMutex
+	subscriptionsPerURI map[string]int64
+
+	heartbeatLocker  sync.Mutex
+	heartbeatLatency time.Duration
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{subscriptionsPerURI: map[string]int64{}}
+}
+
+// OpenConnections is a gauge of currently connected clients.
+func (m *Metrics) OpenConnections() int64 { return atomic.LoadInt64(&m.openConnections) }
+
+// MessagesSent is a counter of frames successfully written to connections.
+func (m *Metrics) MessagesSent() int64 { return atomic.LoadInt64(&m.messagesSent) }
+
+// MessagesReceived is a counter of frames successfully parsed off connections.
+func (m *Metrics) MessagesReceived() int64 { return atomic.LoadInt64(&m.messagesReceived) }
+
+// MessagesDropped is a counter of frames discarded because a connection's
+// send buffer was full past SetSendTimeout, which also disconnects it.
+func (m *Metrics) MessagesDropped() int64 { return atomic.LoadInt64(&m.messagesDropped) }
+
+// RPCCalls is a counter of RPC invocations dispatched to a handler.
+func (m *Metrics) RPCCalls() int64 { return atomic.LoadInt64(&m.rpcCalls) }
+
+// RPCErrors is a counter of RPC invocations whose handler returned an error.
+func (m *Metrics) RPCErrors() int64 { return atomic.LoadInt64(&m.rpcErrors) }
+
+// HeartbeatLatency returns the interval between the two most recent
+// heartbeats of whichever connection sent a heartbeat last (each connection's
+// interval is measured on its own), as a rough proxy for round-trip
+// responsiveness (the server only echoes heartbeats, it doesn't initiate
+// its own ping, so this isn't a true network RTT).
+func (m *Metrics) HeartbeatLatency() time.Duration {
+	m.heartbeatLocker.Lock()
+	defer m.heartbeatLocker.Unlock()
+	return m.heartbeatLatency
+}
+
+// SubscriptionsPerURI returns a snapshot of subscriber counts, keyed by
+// subscribed URI (or pattern, for MatchPrefix/MatchWildcard subscriptions).
+func (m *Metrics) SubscriptionsPerURI() map[string]int64 {
+	m.subscriptionsLocker.RLock()
+	defer m.subscriptionsLocker.RUnlock()
+	out := make(map[string]int64, len(m.subscriptionsPerURI))
+	for uri, n := range m.subscriptionsPerURI {
+		out[uri] = n
+	}
+	return out
+}
+
+func (m *Metrics) setSubscriptionCount(uri string, n int) {
+	m.subscriptionsLocker.Lock()
+	defer m.subscriptionsLocker.Unlock()
+	if n == 0 {
+		delete(m.subscriptionsPerURI, uri)
+		return
+	}
+	m.subscriptionsPerURI[uri] = int64(n)
+}
+
+func (m *Metrics) recordHeartbeat(latency time.Duration) {
+	m.heartbeatLocker.Lock()
+	defer m.heartbeatLocker.Unlock()
+	m.heartbeatLatency = latency
+}
+
+// Metrics returns server's metrics accessor.
+func (server *WS) Metrics() *Metrics {
+	return server.metrics
+}
@@ -0,0 +1,87 @@
+package wango
+
+import (
+	"testing"
+	"time"
+)
+
+type noopTransport struct{}
+
+func (noopTransport) Send(msg string) error    { return nil }
+func (noopTransport) Receive() (string, error) { return "", nil }
+func (noopTransport) Close() error             { return nil }
+
+type authIDExtra string
+
+func (a authIDExtra) AuthID() string { return string(a) }
+
+func TestAuthIDEligible(t *testing.T) {
+	alice := &conn{extra: authIDExtra("alice")}
+	bob := &conn{extra: authIDExtra("bob")}
+	anon := &conn{}
+
+	cases := []struct {
+		name string
+		c    *conn
+		opts PublishOptions
+		want bool
+	}{
+		{"no filters", alice, PublishOptions{}, true},
+		{"excluded", alice, PublishOptions{ExcludeAuthID: []string{"alice"}}, false},
+		{"not excluded", bob, PublishOptions{ExcludeAuthID: []string{"alice"}}, true},
+		{"eligible allow-list hit", alice, PublishOptions{EligibleAuthID: []string{"alice"}}, true},
+		{"eligible allow-list miss", bob, PublishOptions{EligibleAuthID: []string{"alice"}}, false},
+		{"anon fails eligible allow-list", anon, PublishOptions{EligibleAuthID: []string{"alice"}}, false},
+		{"anon passes exclude-only filter", anon, PublishOptions{ExcludeAuthID: []string{"alice"}}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := authIDEligible(tc.c.extra, tc.opts); got != tc.want {
+				t.Fatalf("authIDEligible(...) = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestPublishWithOptionsFiltering subscribes three connections to the same
+// URI and checks that Exclude/ExcludeAuthID actually narrow delivery the way
+// PublishOptions documents, instead of only exercising the no-options
+// Publish path.
+func TestPublishWithOptionsFiltering(t *testing.T) {
+	server := New()
+	alice := server.addConnection(noopTransport{}, authIDExtra("alice"))
+	bob := server.addConnection(noopTransport{}, authIDExtra("bob"))
+	carol := server.addConnection(noopTransport{}, nil)
+
+	server.subscribers["com.example.topic"] = &subscriptionEntry{
+		mode: MatchExact,
+		subscribers: subscribersMap{
+			alice.id: subscriberExists,
+			bob.id:   subscriberExists,
+			carol.id: subscriberExists,
+		},
+	}
+
+	server.PublishWithOptions("com.example.topic", "event", PublishOptions{
+		Exclude:       []string{carol.id},
+		ExcludeAuthID: []string{"bob"},
+	})
+
+	assertReceived(t, alice, true)
+	assertReceived(t, bob, false)
+	assertReceived(t, carol, false)
+}
+
+func assertReceived(t *testing.T, c *conn, want bool) {
+	t.Helper()
+	select {
+	case <-c.sendChan:
+		if !want {
+			t.Fatalf("conn %s received an event it should have been filtered out of", c.id)
+		}
+	case <-time.After(50 * time.Millisecond):
+		if want {
+			t.Fatalf("conn %s never received the expected event", c.id)
+		}
+	}
+}
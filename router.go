@@ -0,0 +1,570 @@
+package wango
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// v2MsgType is a WAMPv2 message code, as defined by the WAMP Basic Profile.
+type v2MsgType int
+
+// Register/Invocation/Yield (64/65/68/70) are deliberately absent: a remote
+// callee can't REGISTER a procedure over the wire here, only the Go-side
+// Realm.Register. Wiring up a real REGISTER/INVOCATION/YIELD round trip
+// would need the dealer to track callee sessions per procedure and proxy
+// CALL through to whichever session holds the registration; until that
+// exists, don't declare codes nothing dispatches on.
+const (
+	v2MsgHello      v2MsgType = 1
+	v2MsgWelcome    v2MsgType = 2
+	v2MsgAbort      v2MsgType = 3
+	v2MsgGoodbye    v2MsgType = 6
+	v2MsgError      v2MsgType = 8
+	v2MsgPublish    v2MsgType = 16
+	v2MsgPublished  v2MsgType = 17
+	v2MsgSubscribe  v2MsgType = 32
+	v2MsgSubscribed v2MsgType = 33
+	v2MsgEvent      v2MsgType = 36
+	v2MsgCall       v2MsgType = 48
+	v2MsgCancel     v2MsgType = 49
+	v2MsgResult     v2MsgType = 50
+)
+
+// Role names accepted in the HELLO details and advertised back in WELCOME.
+const (
+	RoleCaller     = "caller"
+	RoleCallee     = "callee"
+	RolePublisher  = "publisher"
+	RoleSubscriber = "subscriber"
+	RoleDealer     = "dealer"
+	RoleBroker     = "broker"
+)
+
+// Session represents a WAMPv2 session attached to a Realm. It wraps the
+// underlying transport-level conn with the realm and roles negotiated
+// during the HELLO/WELCOME handshake.
+type Session struct {
+	id    string
+	conn  *conn
+	realm *Realm
+	roles []string
+	extra interface{}
+}
+
+// ID returns the session scope ID assigned at WELCOME time.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Realm returns the realm this session was attached to.
+func (s *Session) Realm() *Realm {
+	return s.realm
+}
+
+// Realm is an isolated URI space: RPC registrations, subscriptions and
+// sessions in one realm are never visible from another. Its pub/sub and RPC
+// dispatch is its own implementation, independent of WS's maps, but mirrors
+// WS's semantics: subscriptions are matched via MatchMode (see
+// SubscribeWithMatch), and RegisterCtx calls support cancellation via CANCEL
+// the same way WS's RPCHandlerCtx calls do. Unlike WS, which records a
+// subscription under the topic the client asked for, a realm records it under
+// the registered handler's pattern, so a session subscribed through a
+// MatchPrefix or MatchWildcard handler receives every PUBLISH that pattern
+// matches. Metrics recorded are limited to
+// messagesReceived/rpcCalls/rpcErrors and per-pattern subscription counts.
+type Realm struct {
+	uri            string
+	rpcHandlers    map[string]RPCHandler
+	rpcCtxHandlers map[string]RPCHandlerCtx
+	subHandlers    map[string]subHandler
+	subscribers    map[string]*subscriptionEntry
+	sessions       map[string]*Session
+	locker         sync.RWMutex
+}
+
+func newRealm(uri string) *Realm {
+	return &Realm{
+		uri:            uri,
+		rpcHandlers:    map[string]RPCHandler{},
+		rpcCtxHandlers: map[string]RPCHandlerCtx{},
+		subHandlers:    map[string]subHandler{},
+		subscribers:    map[string]*subscriptionEntry{},
+		sessions:       map[string]*Session{},
+	}
+}
+
+// Register registers an RPC handler for uri within this realm. This is the
+// only way to expose a procedure: there is no REGISTER wire message, so a
+// remote callee can't register one of its own.
+func (r *Realm) Register(uri string, fn RPCHandler) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if _, ok := r.rpcHandlers[uri]; ok {
+		return errors.Wrap(ErrHandlerAlreadyRegistered, "when registering realm rpc handler")
+	}
+	r.rpcHandlers[uri] = fn
+	return nil
+}
+
+// RegisterCtx registers a cancellable RPC handler for uri within this realm,
+// the same way WS.RegisterRPCHandlerCtx does for v1 calls. A CALL against uri
+// runs in its own goroutine so a later CANCEL for the same Request|id can
+// stop it early. The handler's connID is the session ID, while the call is
+// tracked under the underlying connection's ID, so Progress called with the
+// handler's connID and callID returns ErrCallNotInFlight; Progress frames are
+// v1 CALL_RESULT frames in any case. Partial results are not streamed to v2
+// sessions.
+func (r *Realm) RegisterCtx(uri string, fn RPCHandlerCtx) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if _, ok := r.rpcCtxHandlers[uri]; ok {
+		return errors.Wrap(ErrHandlerAlreadyRegistered, "when registering realm rpc handler")
+	}
+	r.rpcCtxHandlers[uri] = fn
+	return nil
+}
+
+// Subscribe registers a subscription handler for uri within this realm,
+// matching subscribed URIs exactly; see SubscribeWithMatch for
+// MatchPrefix/MatchWildcard.
+func (r *Realm) Subscribe(uri string, fnSub SubHandler, fnPub PubHandler) error {
+	return r.SubscribeWithMatch(uri, MatchExact, fnSub, fnPub)
+}
+
+// SubscribeWithMatch registers a subscription handler for uri within this
+// realm using the given MatchMode, the same way
+// WS.RegisterSubHandlerWithMatch does for v1 subscriptions.
+func (r *Realm) SubscribeWithMatch(uri string, mode MatchMode, fnSub SubHandler, fnPub PubHandler) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if _, ok := r.subHandlers[uri]; ok {
+		return errors.Wrap(ErrHandlerAlreadyRegistered, "when registering realm sub handler")
+	}
+	r.subHandlers[uri] = subHandler{subHandler: fnSub, pubHandler: fnPub, match: mode}
+	return nil
+}
+
+// Router wraps WS with WAMPv2 realms, sessions and role negotiation, while
+// keeping the v1 code paths on WS fully functional for clients that still
+// speak the legacy flat-namespace protocol. Frames are always JSON; there is
+// no MessagePack or other wire format negotiated during HELLO.
+type Router struct {
+	*WS
+	realms       map[string]*Realm
+	realmsLocker sync.RWMutex
+}
+
+// NewRouter creates a Router on top of a fresh WS instance.
+func NewRouter() *Router {
+	return &Router{
+		WS:     New(),
+		realms: map[string]*Realm{},
+	}
+}
+
+// AddRealm declares a new realm identified by uri. It is an error to add the
+// same realm uri twice.
+func (router *Router) AddRealm(uri string) (*Realm, error) {
+	router.realmsLocker.Lock()
+	defer router.realmsLocker.Unlock()
+	if _, ok := router.realms[uri]; ok {
+		return nil, errors.Wrap(ErrHandlerAlreadyRegistered, "when adding realm")
+	}
+	realm := newRealm(uri)
+	router.realms[uri] = realm
+	return realm, nil
+}
+
+func (router *Router) getRealm(uri string) (*Realm, bool) {
+	router.realmsLocker.RLock()
+	defer router.realmsLocker.RUnlock()
+	realm, ok := router.realms[uri]
+	return realm, ok
+}
+
+// WampHandler handles a connection for either WAMP v1 or v2, detecting the
+// version from the first frame. v1 connections are handled exactly like
+// WS.WampHandler; v2 connections are dispatched against realms.
+func (router *Router) WampHandler(ws *websocket.Conn, extra interface{}) {
+	router.WampHandlerTransport(NewXNetWebsocketTransport(ws), extra)
+}
+
+// WampHandlerTransport handles a Router connection over any Transport, the
+// same way WS.WampHandlerTransport does for plain v1 connections, including
+// running the HELLO/CHALLENGE/AUTHENTICATE handshake first when an
+// Authenticator is set via SetAuthenticator.
+func (router *Router) WampHandlerTransport(t Transport, extra interface{}) {
+	c := router.addConnection(t, extra)
+	defer router.deleteConnection(c.id)
+
+	if router.authenticator != nil {
+		authExtra, ok := router.authenticate(c)
+		if !ok {
+			return
+		}
+		c.extra = authExtra
+	}
+
+	go c.sender()
+	router.receiveVersioned(c)
+}
+
+func (router *Router) receiveVersioned(c *conn) {
+	defer c.connection.Close()
+
+	var session *Session
+	for {
+		data, err := c.connection.Receive()
+		if err != nil {
+			break
+		}
+		msgType, msg, err := parseMessage(data)
+		if err != nil {
+			println("Error:", err.Error())
+			continue
+		}
+		atomic.AddInt64(&router.metrics.messagesReceived, 1)
+
+		if session == nil {
+			if !detectVersion(msg) {
+				router.handleV1(c, msgType, msg, data)
+				continue
+			}
+			router.handleHello(c, msg)
+			if s, ok := c.extra.(*Session); ok {
+				session = s
+			}
+			continue
+		}
+
+		router.handleV2(session, v2MsgType(toFloat(msg[0])), msg)
+	}
+}
+
+func toFloat(v interface{}) float64 {
+	f, _ := v.(float64)
+	return f
+}
+
+// handleV1 re-dispatches a v1 frame using WS's existing message handlers, so
+// that legacy clients keep working unmodified behind a Router.
+func (router *Router) handleV1(c *conn, msgType int, msg []interface{}, data string) {
+	switch msgType {
+	case msgCall:
+		router.WS.handleRPCCall(c, msg)
+	case msgSubscribe:
+		router.WS.handleSubscribe(c, msg)
+	case msgUnsubscribe:
+		router.WS.handleUnSubscribe(c, msg)
+	case msgPublish:
+		router.WS.handlePublish(c, msg)
+	case msgHeartbeat:
+		router.WS.handleHeartbeat(c, msg, data)
+	case msgCancel:
+		router.WS.handleCancel(c, msg)
+	}
+}
+
+// detectVersion sniffs the first frame of a connection and reports whether
+// it is a WAMPv2 HELLO ([1, "realm", {...}]) or a v1 message. The leading
+// code alone isn't enough: WAMPv1's TYPE_ID_PREFIX is also 1, the same value
+// as v2MsgHello ([1, prefix, "http://...#uri"] vs. [1, "realm", {...}]). The
+// two only diverge at msg[2], which is a details dict for HELLO and a plain
+// URI string for PREFIX, so require that shape too.
+func detectVersion(msg []interface{}) bool {
+	if len(msg) < 3 {
+		return false
+	}
+	code, ok := msg[0].(float64)
+	if !ok || v2MsgType(code) != v2MsgHello {
+		return false
+	}
+	_, detailsAreDict := msg[2].(map[string]interface{})
+	return detailsAreDict
+}
+
+func (router *Router) handleHello(c *conn, msg []interface{}) {
+	if len(msg) < 2 {
+		return
+	}
+	realmURI, _ := msg[1].(string)
+	realm, ok := router.getRealm(realmURI)
+	if !ok {
+		response, _ := createMessage(v2MsgAbort, realmURI, createError(ErrSubURINotRegistered))
+		c.send(response)
+		return
+	}
+
+	var details map[string]interface{}
+	if len(msg) > 2 {
+		details, _ = msg[2].(map[string]interface{})
+	}
+	roles := rolesFromDetails(details)
+
+	session := &Session{
+		id:    newUUIDv4(),
+		conn:  c,
+		realm: realm,
+		roles: roles,
+		extra: c.extra,
+	}
+	realm.locker.Lock()
+	realm.sessions[session.id] = session
+	realm.locker.Unlock()
+	c.extra = session
+
+	response, _ := createMessage(v2MsgWelcome, session.id, map[string]interface{}{
+		"roles": map[string]interface{}{
+			RoleBroker: map[string]interface{}{},
+			RoleDealer: map[string]interface{}{},
+		},
+	})
+	c.send(response)
+}
+
+func rolesFromDetails(details map[string]interface{}) []string {
+	rawRoles, ok := details["roles"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	roles := make([]string, 0, len(rawRoles))
+	for role := range rawRoles {
+		roles = append(roles, role)
+	}
+	return roles
+}
+
+// handleV2 dispatches a single WAMPv2 frame for a session that has already
+// completed the HELLO/WELCOME handshake.
+func (router *Router) handleV2(session *Session, msgType v2MsgType, msg []interface{}) {
+	switch msgType {
+	case v2MsgGoodbye:
+		router.handleV2Goodbye(session)
+	case v2MsgSubscribe:
+		router.handleV2Subscribe(session, msg)
+	case v2MsgPublish:
+		router.handleV2Publish(session, msg)
+	case v2MsgCall:
+		router.handleV2Call(session, msg)
+	case v2MsgCancel:
+		router.handleV2Cancel(session, msg)
+	}
+}
+
+func (router *Router) handleV2Goodbye(session *Session) {
+	realm := session.realm
+	realm.locker.Lock()
+	delete(realm.sessions, session.id)
+	realm.locker.Unlock()
+	response, _ := createMessage(v2MsgGoodbye, "wamp.close.goodbye_and_out", map[string]interface{}{})
+	session.conn.send(response)
+}
+
+func (router *Router) handleV2Subscribe(session *Session, msg []interface{}) {
+	// [SUBSCRIBE, Request|id, Options|dict, Topic|uri]
+	if len(msg) < 4 {
+		return
+	}
+	requestID := msg[1]
+	uri, _ := msg[3].(string)
+
+	realm := session.realm
+	realm.locker.Lock()
+	defer realm.locker.Unlock()
+
+	for pattern, handler := range realm.subHandlers {
+		if !matchURI(pattern, uri, handler.match) {
+			continue
+		}
+		if !handler.subHandler(session.id, uri) {
+			response, _ := createMessage(v2MsgError, requestID, createError(ErrForbidden))
+			session.conn.send(response)
+			return
+		}
+		entry, ok := realm.subscribers[pattern]
+		if !ok {
+			entry = &subscriptionEntry{mode: handler.match, subscribers: subscribersMap{}}
+			realm.subscribers[pattern] = entry
+		}
+		entry.subscribers[session.id] = subscriberExists
+		router.metrics.setSubscriptionCount(pattern, len(entry.subscribers))
+
+		response, _ := createMessage(v2MsgSubscribed, requestID, uri)
+		session.conn.send(response)
+		return
+	}
+
+	response, _ := createMessage(v2MsgError, requestID, createError(ErrSubURINotRegistered))
+	session.conn.send(response)
+}
+
+func (router *Router) handleV2Publish(session *Session, msg []interface{}) {
+	// [PUBLISH, Request|id, Options|dict, Topic|uri, Arguments|list (optional)]
+	if len(msg) < 4 {
+		return
+	}
+	requestID := msg[1]
+	rawOptions, _ := msg[2].(map[string]interface{})
+	uri, _ := msg[3].(string)
+	var event interface{}
+	if len(msg) > 4 {
+		event = msg[4]
+	}
+
+	opts := parsePublishOptions(rawOptions)
+	if opts.ExcludeMe {
+		opts.Exclude = append(opts.Exclude, session.id)
+	}
+	exclude := toSet(opts.Exclude)
+	var eligible map[string]bool
+	if len(opts.Eligible) > 0 {
+		eligible = toSet(opts.Eligible)
+	}
+
+	realm := session.realm
+	realm.locker.RLock()
+	handler, hasHandler := realm.subHandlers[uri]
+	subscriberIDSet := map[string]bool{}
+	for pattern, entry := range realm.subscribers {
+		if !matchURI(pattern, uri, entry.mode) {
+			continue
+		}
+		for id := range entry.subscribers {
+			subscriberIDSet[id] = true
+		}
+	}
+	realm.locker.RUnlock()
+
+	for id := range subscriberIDSet {
+		if exclude[id] {
+			continue
+		}
+		if eligible != nil && !eligible[id] {
+			continue
+		}
+		realm.locker.RLock()
+		subscriber, ok := realm.sessions[id]
+		realm.locker.RUnlock()
+		if !ok {
+			continue
+		}
+		if !authIDEligible(subscriber.extra, opts) {
+			continue
+		}
+		event := event
+		if hasHandler && handler.pubHandler != nil {
+			var allow bool
+			allow, event = handler.pubHandler(uri, event, subscriber.extra)
+			if !allow {
+				continue
+			}
+		}
+		response, _ := createMessage(v2MsgEvent, uri, event)
+		subscriber.conn.send(response)
+	}
+
+	response, _ := createMessage(v2MsgPublished, requestID, uri)
+	session.conn.send(response)
+}
+
+func (router *Router) handleV2Call(session *Session, msg []interface{}) {
+	// [CALL, Request|id, Options|dict, Procedure|uri, Arguments|list (optional)]
+	if len(msg) < 4 {
+		return
+	}
+	requestID := msg[1]
+	uri, _ := msg[3].(string)
+	var args []interface{}
+	if len(msg) > 4 {
+		args, _ = msg[4].([]interface{})
+	}
+
+	realm := session.realm
+	realm.locker.RLock()
+	ctxHandler, hasCtxHandler := realm.rpcCtxHandlers[uri]
+	handler, ok := realm.rpcHandlers[uri]
+	realm.locker.RUnlock()
+
+	if hasCtxHandler {
+		router.callV2RPCHandlerCtx(session, requestID, uri, ctxHandler, args)
+		return
+	}
+
+	if !ok {
+		response, _ := createMessage(v2MsgError, requestID, createError(ErrRPCNotRegistered))
+		session.conn.send(response)
+		return
+	}
+
+	atomic.AddInt64(&router.metrics.rpcCalls, 1)
+	res, err := handler(session.id, uri, args...)
+	if err != nil {
+		atomic.AddInt64(&router.metrics.rpcErrors, 1)
+		response, _ := createMessage(v2MsgError, requestID, createError(err))
+		session.conn.send(response)
+		return
+	}
+	response, _ := createMessage(v2MsgResult, requestID, res)
+	session.conn.send(response)
+}
+
+// callV2RPCHandlerCtx runs a realm RPCHandlerCtx call in its own goroutine,
+// the same way WS.callRPCHandlerCtx does for v1 calls, reusing the Router's
+// (embedded WS's) inFlightCalls/callConnections bookkeeping so a later
+// CANCEL, or the connection closing, can stop it. The v2 Request|id is numeric, so
+// it's formatted into the same string call ID key v1 calls use.
+func (router *Router) callV2RPCHandlerCtx(session *Session, requestID interface{}, uri string, handler RPCHandlerCtx, args []interface{}) {
+	callID := fmt.Sprintf("%v", requestID)
+	ctx, cancel := context.WithCancel(context.Background())
+	key := inFlightKey(session.conn.id, callID)
+
+	router.inFlightLocker.Lock()
+	router.inFlightCalls[key] = cancel
+	router.callConnections[key] = session.conn
+	router.inFlightLocker.Unlock()
+	atomic.AddInt64(&router.metrics.rpcCalls, 1)
+
+	go func() {
+		defer func() {
+			router.inFlightLocker.Lock()
+			delete(router.inFlightCalls, key)
+			delete(router.callConnections, key)
+			router.inFlightLocker.Unlock()
+			cancel()
+		}()
+
+		res, err := handler(ctx, callID, session.id, uri, args...)
+		if ctx.Err() != nil {
+			// cancelled or the connection is gone; nothing to send back
+			return
+		}
+		if err != nil {
+			atomic.AddInt64(&router.metrics.rpcErrors, 1)
+			response, _ := createMessage(v2MsgError, requestID, createError(err))
+			session.conn.send(response)
+			return
+		}
+		response, _ := createMessage(v2MsgResult, requestID, res)
+		session.conn.send(response)
+	}()
+}
+
+func (router *Router) handleV2Cancel(session *Session, msg []interface{}) {
+	// [CANCEL, Request|id, Options|dict]
+	if len(msg) < 2 {
+		return
+	}
+	callID := fmt.Sprintf("%v", msg[1])
+
+	router.inFlightLocker.Lock()
+	cancel, ok := router.inFlightCalls[inFlightKey(session.conn.id, callID)]
+	router.inFlightLocker.Unlock()
+	if ok {
+		cancel()
+	}
+}
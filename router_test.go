@@ -0,0 +1,332 @@
+package wango
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// routerTestTransport is an in-memory Transport for driving
+// Router.receiveVersioned without a real socket. Frames written by the
+// router are published on out.
+type routerTestTransport struct {
+	in  chan string
+	out chan string
+}
+
+func newRouterTestTransport() *routerTestTransport {
+	return &routerTestTransport{
+		in:  make(chan string, 8),
+		out: make(chan string, 8),
+	}
+}
+
+func (t *routerTestTransport) Send(msg string) error {
+	t.out <- msg
+	return nil
+}
+
+func (t *routerTestTransport) Receive() (string, error) {
+	msg, ok := <-t.in
+	if !ok {
+		return "", io.EOF
+	}
+	return msg, nil
+}
+
+func (t *routerTestTransport) Close() error {
+	close(t.in)
+	return nil
+}
+
+func TestDetectVersionDoesNotCollideWithV1Prefix(t *testing.T) {
+	// WAMPv1's TYPE_ID_PREFIX shares the integer 1 with v2MsgHello, so a v1
+	// PREFIX frame ([1, prefix, URI]) must not be mistaken for a v2 HELLO
+	// ([1, realm, details-dict]) just because msg[0] matches.
+	_, prefixMsg, err := parseMessage(mustCreateMessage(t, msgPrefix, "foo", "http://example.com/ns#"))
+	if err != nil {
+		t.Fatalf("parsing v1 PREFIX frame: %v", err)
+	}
+	if detectVersion(prefixMsg) {
+		t.Fatal("v1 PREFIX frame misdetected as a v2 HELLO")
+	}
+
+	_, helloMsg, err := parseMessage(mustCreateMessage(t, v2MsgHello, "realm1", map[string]interface{}{"roles": map[string]interface{}{}}))
+	if err != nil {
+		t.Fatalf("parsing v2 HELLO frame: %v", err)
+	}
+	if !detectVersion(helloMsg) {
+		t.Fatal("v2 HELLO frame not detected as v2")
+	}
+}
+
+func mustCreateMessage(t *testing.T, msgType interface{}, args ...interface{}) string {
+	t.Helper()
+	data, err := createMessage(msgType, args...)
+	if err != nil {
+		t.Fatalf("createMessage: %v", err)
+	}
+	return string(data)
+}
+
+// TestHandleV2SubscribePublishCallOptionsIndex drives a full, spec-shaped
+// HELLO/SUBSCRIBE/PUBLISH/CALL exchange through a Router and checks that the
+// topic/procedure URI is read from the correct frame position (msg[3], after
+// the mandatory Options|dict at msg[2]), not msg[2] itself.
+func TestHandleV2SubscribePublishCallOptionsIndex(t *testing.T) {
+	router := NewRouter()
+	realm, err := router.AddRealm("realm1")
+	if err != nil {
+		t.Fatalf("AddRealm: %v", err)
+	}
+
+	gotSubURI := make(chan string, 1)
+	if err := realm.Subscribe("a.b.c", func(connID, uri string, args ...interface{}) bool {
+		gotSubURI <- uri
+		return true
+	}, nil); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	gotCallURI := make(chan string, 1)
+	if err := realm.Register("a.b.c", func(connID, uri string, args ...interface{}) (interface{}, error) {
+		gotCallURI <- uri
+		return "ok", nil
+	}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	transport := newRouterTestTransport()
+	c := &conn{id: "conn-1", connection: transport, server: router.WS, sendChan: make(chan interface{}, 8)}
+	go c.sender()
+	go router.receiveVersioned(c)
+
+	transport.in <- mustCreateMessage(t, v2MsgHello, "realm1", map[string]interface{}{"roles": map[string]interface{}{}})
+	<-transport.out // WELCOME
+
+	transport.in <- mustCreateMessage(t, v2MsgSubscribe, float64(1), map[string]interface{}{}, "a.b.c")
+	select {
+	case uri := <-gotSubURI:
+		if uri != "a.b.c" {
+			t.Fatalf("expected subscribe uri %q, got %q", "a.b.c", uri)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for SUBSCRIBE to reach the sub handler")
+	}
+	<-transport.out // SUBSCRIBED
+
+	transport.in <- mustCreateMessage(t, v2MsgCall, float64(2), map[string]interface{}{}, "a.b.c", []interface{}{})
+	select {
+	case uri := <-gotCallURI:
+		if uri != "a.b.c" {
+			t.Fatalf("expected call uri %q, got %q", "a.b.c", uri)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for CALL to reach the rpc handler")
+	}
+	<-transport.out // RESULT
+
+	if got := router.Metrics().RPCCalls(); got != 1 {
+		t.Fatalf("RPCCalls() = %d, want 1", got)
+	}
+	if got := router.Metrics().SubscriptionsPerURI()["a.b.c"]; got != 1 {
+		t.Fatalf("SubscriptionsPerURI()[\"a.b.c\"] = %d, want 1", got)
+	}
+}
+
+// TestHandleV2SubscribeMatchModes checks that a realm subscription honors
+// the MatchMode it was registered with, the same way WS's subHandlers do:
+// a MatchPrefix subHandler sees a PUBLISH to a longer URI under its prefix,
+// and an unmatched topic is rejected with SubURINotRegistered rather than
+// silently accepted.
+func TestHandleV2SubscribeMatchModes(t *testing.T) {
+	router := NewRouter()
+	realm, err := router.AddRealm("realm1")
+	if err != nil {
+		t.Fatalf("AddRealm: %v", err)
+	}
+	if err := realm.SubscribeWithMatch("com.example", MatchPrefix, func(connID, uri string, args ...interface{}) bool {
+		return true
+	}, nil); err != nil {
+		t.Fatalf("SubscribeWithMatch: %v", err)
+	}
+
+	transport := newRouterTestTransport()
+	c := &conn{id: "conn-1", connection: transport, server: router.WS, sendChan: make(chan interface{}, 8)}
+	go c.sender()
+	go router.receiveVersioned(c)
+
+	transport.in <- mustCreateMessage(t, v2MsgHello, "realm1", map[string]interface{}{"roles": map[string]interface{}{}})
+	<-transport.out // WELCOME
+
+	transport.in <- mustCreateMessage(t, v2MsgSubscribe, float64(1), map[string]interface{}{}, "com.example.widget")
+	subscribedFrame := <-transport.out
+	_, subscribedMsg, err := parseMessage(subscribedFrame)
+	if err != nil || v2MsgType(toFloat(subscribedMsg[0])) != v2MsgSubscribed {
+		t.Fatalf("expected SUBSCRIBED for a prefix-matched topic, got %q", subscribedFrame)
+	}
+
+	// exclude_me defaults to true, and this session is the only subscriber.
+	transport.in <- mustCreateMessage(t, v2MsgPublish, float64(2), map[string]interface{}{"exclude_me": false}, "com.example.widget", []interface{}{"hi"})
+	eventFrame := <-transport.out
+	_, eventMsg, err := parseMessage(eventFrame)
+	if err != nil || v2MsgType(toFloat(eventMsg[0])) != v2MsgEvent {
+		t.Fatalf("expected an EVENT delivered via the prefix match, got %q", eventFrame)
+	}
+	<-transport.out // PUBLISHED
+
+	transport.in <- mustCreateMessage(t, v2MsgSubscribe, float64(3), map[string]interface{}{}, "com.other.topic")
+	errorFrame := <-transport.out
+	_, errorMsg, err := parseMessage(errorFrame)
+	if err != nil || v2MsgType(toFloat(errorMsg[0])) != v2MsgError {
+		t.Fatalf("expected ERROR for an unregistered topic, got %q", errorFrame)
+	}
+
+	if got := router.Metrics().SubscriptionsPerURI()["com.example"]; got != 1 {
+		t.Fatalf("SubscriptionsPerURI()[\"com.example\"] = %d, want 1", got)
+	}
+}
+
+// TestHandleV2PublishOptionsFiltering checks that a v2 PUBLISH applies
+// PublishOptions the same way WS.PublishWithOptions does: exclude_me
+// defaults to true for the publisher, and exclude_authid filters out a
+// subscriber whose conn.extra (threaded onto Session.extra at HELLO time)
+// reports a matching AuthID.
+func TestHandleV2PublishOptionsFiltering(t *testing.T) {
+	router := NewRouter()
+	realm, err := router.AddRealm("realm1")
+	if err != nil {
+		t.Fatalf("AddRealm: %v", err)
+	}
+	if err := realm.Subscribe("a.b.c", func(connID, uri string, args ...interface{}) bool {
+		return true
+	}, nil); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	join := func(id string, extra interface{}) *routerTestTransport {
+		transport := newRouterTestTransport()
+		c := &conn{id: id, connection: transport, server: router.WS, sendChan: make(chan interface{}, 8), extra: extra}
+		go c.sender()
+		go router.receiveVersioned(c)
+		transport.in <- mustCreateMessage(t, v2MsgHello, "realm1", map[string]interface{}{"roles": map[string]interface{}{}})
+		<-transport.out // WELCOME
+		transport.in <- mustCreateMessage(t, v2MsgSubscribe, float64(1), map[string]interface{}{}, "a.b.c")
+		<-transport.out // SUBSCRIBED
+		return transport
+	}
+
+	alice := join("alice-conn", authIDExtra("alice"))
+	bob := join("bob-conn", authIDExtra("bob"))
+	carol := join("carol-conn", nil)
+
+	bob.in <- mustCreateMessage(t, v2MsgPublish, float64(2), map[string]interface{}{
+		"exclude_authid": []interface{}{"alice"},
+	}, "a.b.c", []interface{}{"hi"})
+	<-bob.out // PUBLISHED
+
+	select {
+	case frame := <-alice.out:
+		t.Fatalf("alice should have been excluded by exclude_authid, got %q", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+	select {
+	case frame := <-bob.out:
+		t.Fatalf("bob (the publisher) should have been excluded by the exclude_me default, got %q", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+	select {
+	case frame := <-carol.out:
+		_, eventMsg, err := parseMessage(frame)
+		if err != nil || v2MsgType(toFloat(eventMsg[0])) != v2MsgEvent {
+			t.Fatalf("expected carol to receive an EVENT, got %q", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("carol never received the EVENT")
+	}
+}
+
+// TestHandleV2CallCtxCancel drives a CALL against a realm RPCHandlerCtx
+// handler and checks that a follow-up CANCEL for the same Request|id
+// actually cancels the handler's context instead of the call running to
+// completion regardless.
+func TestHandleV2CallCtxCancel(t *testing.T) {
+	router := NewRouter()
+	realm, err := router.AddRealm("realm1")
+	if err != nil {
+		t.Fatalf("AddRealm: %v", err)
+	}
+
+	handlerDone := make(chan error, 1)
+	if err := realm.RegisterCtx("a.b.c", func(ctx context.Context, callID, connID, uri string, args ...interface{}) (interface{}, error) {
+		<-ctx.Done()
+		handlerDone <- ctx.Err()
+		return nil, ctx.Err()
+	}); err != nil {
+		t.Fatalf("RegisterCtx: %v", err)
+	}
+
+	transport := newRouterTestTransport()
+	c := &conn{id: "conn-1", connection: transport, server: router.WS, sendChan: make(chan interface{}, 8)}
+	go c.sender()
+	go router.receiveVersioned(c)
+
+	transport.in <- mustCreateMessage(t, v2MsgHello, "realm1", map[string]interface{}{"roles": map[string]interface{}{}})
+	<-transport.out // WELCOME
+
+	transport.in <- mustCreateMessage(t, v2MsgCall, float64(7), map[string]interface{}{}, "a.b.c", []interface{}{})
+	transport.in <- mustCreateMessage(t, v2MsgCancel, float64(7), map[string]interface{}{})
+
+	select {
+	case err := <-handlerDone:
+		if err != context.Canceled {
+			t.Fatalf("handler context err = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CANCEL never reached the in-flight RPCHandlerCtx call")
+	}
+}
+
+// TestWampHandlerTransportEnforcesAuthenticator checks that Router.WampHandlerTransport
+// runs the handshake gate before dispatching any v2 frames, the same way
+// WS.WampHandlerTransport does, so SetAuthenticator isn't a silent no-op on
+// the v2 path.
+func TestWampHandlerTransportEnforcesAuthenticator(t *testing.T) {
+	router := NewRouter()
+	router.SetAuthenticator(craAuthenticator{secret: "s3cr3t"})
+	if _, err := router.AddRealm("realm1"); err != nil {
+		t.Fatalf("AddRealm: %v", err)
+	}
+
+	transport := newFakeAuthTransport()
+	done := make(chan struct{})
+	go func() {
+		router.WampHandlerTransport(transport, nil)
+		close(done)
+	}()
+
+	transport.in <- mustCreateMessage(t, authMsgChallenge, "alice", AuthMethodWAMPCRA)
+
+	challengeFrame := <-transport.out
+	_, challengeMsg, err := parseMessage(challengeFrame)
+	if err != nil || len(challengeMsg) < 2 {
+		t.Fatalf("expected a well-formed CHALLENGE frame, got %q (err=%v)", challengeFrame, err)
+	}
+	challenge, _ := challengeMsg[1].(string)
+
+	transport.in <- mustCreateMessage(t, authMsgChallenge, signWAMPCRA("s3cr3t", challenge))
+
+	select {
+	case <-done:
+		t.Fatal("WampHandlerTransport returned before the handshake completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	transport.in <- mustCreateMessage(t, v2MsgHello, "realm1", map[string]interface{}{"roles": map[string]interface{}{}})
+	welcomeFrame := <-transport.out
+	_, welcomeMsg, err := parseMessage(welcomeFrame)
+	if err != nil || v2MsgType(toFloat(welcomeMsg[0])) != v2MsgWelcome {
+		t.Fatalf("expected a WELCOME frame once authenticated, got %q", welcomeFrame)
+	}
+}
@@ -0,0 +1,135 @@
+package wango
+
+import (
+	"context"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// msgCancel is the wire message type for a client asking to cancel a
+// still-running RPC call started with msgCall.
+const msgCancel = 49
+
+// RPCHandlerCtx is like RPCHandler, but receives a context that is
+// cancelled when the caller sends a CANCEL message or disconnects, so
+// long-running RPCs can stop early and stream partial results via Progress.
+type RPCHandlerCtx func(ctx context.Context, callID string, connID string, uri string, args ...interface{}) (interface{}, error)
+
+// ErrCallNotInFlight is returned by Progress when callID isn't a currently
+// running RPCHandlerCtx call.
+var ErrCallNotInFlight = errors.New("call not in flight")
+
+func inFlightKey(connID, callID string) string {
+	return connID + ":" + callID
+}
+
+// RegisterRPCHandlerCtx registers a cancellable, progress-capable RPC
+// handler for provided URI, the same way RegisterRPCHandler does for plain
+// RPCHandler funcs.
+func (server *WS) RegisterRPCHandlerCtx(_uri interface{}, fn RPCHandlerCtx) error {
+	switch uri := _uri.(type) {
+	case string:
+		if _, ok := server.rpcCtxHandlers[uri]; ok {
+			return errors.Wrap(ErrHandlerAlreadyRegistered, "when registering string rpcHandlerCtx")
+		}
+		server.rpcCtxHandlers[uri] = fn
+	case *regexp.Regexp:
+		for k := range server.rpcCtxRgxHandlers {
+			if k.String() == uri.String() {
+				return errors.Wrap(ErrHandlerAlreadyRegistered, "when registering rgx rpcHandlerCtx")
+			}
+		}
+		server.rpcCtxRgxHandlers[uri] = fn
+	}
+
+	return nil
+}
+
+func (server *WS) lookupRPCHandlerCtx(uri string) (RPCHandlerCtx, bool) {
+	if handler, ok := server.rpcCtxHandlers[uri]; ok {
+		return handler, true
+	}
+	for rgx, handler := range server.rpcCtxRgxHandlers {
+		if rgx.MatchString(uri) {
+			return handler, true
+		}
+	}
+	return nil, false
+}
+
+// callRPCHandlerCtx runs handler in its own goroutine so the connection's
+// receive loop stays free to read a later CANCEL message for callID.
+func (server *WS) callRPCHandlerCtx(c *conn, callID string, uri string, handler RPCHandlerCtx, args []interface{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	key := inFlightKey(c.id, callID)
+
+	server.inFlightLocker.Lock()
+	server.inFlightCalls[key] = cancel
+	server.callConnections[key] = c
+	server.inFlightLocker.Unlock()
+	atomic.AddInt64(&server.metrics.rpcCalls, 1)
+
+	go func() {
+		defer func() {
+			server.inFlightLocker.Lock()
+			delete(server.inFlightCalls, key)
+			delete(server.callConnections, key)
+			server.inFlightLocker.Unlock()
+			cancel()
+		}()
+
+		res, err := handler(ctx, callID, c.id, uri, args...)
+		if ctx.Err() != nil {
+			// cancelled or the connection is gone; nothing to send back
+			return
+		}
+		if err != nil {
+			atomic.AddInt64(&server.metrics.rpcErrors, 1)
+			response, _ := createMessage(msgCallError, callID, createError(err))
+			c.send(response)
+			return
+		}
+		response, _ := createMessage(msgCallResult, callID, res)
+		c.send(response)
+	}()
+}
+
+func (server *WS) handleCancel(c *conn, msg []interface{}) {
+	if len(msg) < 1 {
+		return
+	}
+	callID, _ := msg[0].(string)
+
+	server.inFlightLocker.Lock()
+	cancel, ok := server.inFlightCalls[inFlightKey(c.id, callID)]
+	server.inFlightLocker.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// Progress sends an interim result for the in-flight RPC call identified by
+// connID and callID, with a progress:true detail so the caller can tell it
+// apart from the final CALL_RESULT. connID and callID are the same values
+// RPCHandlerCtx was called with; callID alone isn't enough to identify the
+// call, since each client picks its own call IDs independently and two
+// connections can have the same callID in flight at once. It returns
+// ErrCallNotInFlight if the call already completed, was cancelled, or never
+// existed.
+func (server *WS) Progress(connID string, callID string, chunk interface{}) error {
+	server.inFlightLocker.Lock()
+	c, ok := server.callConnections[inFlightKey(connID, callID)]
+	server.inFlightLocker.Unlock()
+	if !ok {
+		return errors.Wrap(ErrCallNotInFlight, "when sending progress")
+	}
+
+	response, err := createMessage(msgCallResult, callID, chunk, map[string]interface{}{"progress": true})
+	if err != nil {
+		return err
+	}
+	c.send(response)
+	return nil
+}
@@ -0,0 +1,81 @@
+package wango
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// collidingCallTransport is a no-op Transport; callRPCHandlerCtx only needs
+// a *conn to route Progress/results to, it never reads from the transport.
+type collidingCallTransport struct{}
+
+func (collidingCallTransport) Send(msg string) error    { return nil }
+func (collidingCallTransport) Receive() (string, error) { return "", nil }
+func (collidingCallTransport) Close() error             { return nil }
+
+// TestCallConnectionsKeyedByConnAndCall reproduces two different connections
+// racing an in-flight call under the same client-chosen callID, and checks
+// that Progress delivers each chunk to the connection that owns it instead
+// of whichever connection started or finished last.
+func TestCallConnectionsKeyedByConnAndCall(t *testing.T) {
+	server := New()
+	connA := server.addConnection(collidingCallTransport{}, nil)
+	connB := server.addConnection(collidingCallTransport{}, nil)
+
+	release := make(chan struct{})
+	handler := func(ctx context.Context, callID string, connID string, uri string, args ...interface{}) (interface{}, error) {
+		<-release
+		return "done", nil
+	}
+
+	const callID = "1"
+	server.callRPCHandlerCtx(connA, callID, "a.b.c", handler, nil)
+	server.callRPCHandlerCtx(connB, callID, "a.b.c", handler, nil)
+
+	if err := server.Progress(connA.id, callID, "chunk-for-a"); err != nil {
+		t.Fatalf("Progress for connA: %v", err)
+	}
+	if err := server.Progress(connB.id, callID, "chunk-for-b"); err != nil {
+		t.Fatalf("Progress for connB: %v", err)
+	}
+
+	select {
+	case msg := <-connA.sendChan:
+		assertProgressFor(t, msg, "chunk-for-a")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for connA's progress chunk")
+	}
+	select {
+	case msg := <-connB.sendChan:
+		assertProgressFor(t, msg, "chunk-for-b")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for connB's progress chunk")
+	}
+
+	close(release)
+
+	if _, err := server.getConnection(connA.id); err != nil {
+		t.Fatalf("connA should still be registered: %v", err)
+	}
+}
+
+func assertProgressFor(t *testing.T, msg interface{}, wantChunk string) {
+	t.Helper()
+	data, ok := msg.(string)
+	if !ok {
+		t.Fatalf("expected a string frame, got %T", msg)
+	}
+	_, parsed, err := parseMessage(data)
+	if err != nil || len(parsed) < 2 {
+		t.Fatalf("expected a well-formed CALL_RESULT frame, got %q (err=%v)", data, err)
+	}
+	callID, _ := parsed[0].(string)
+	if callID != "1" {
+		t.Fatalf("expected callID %q, got %q", "1", callID)
+	}
+	chunk, _ := parsed[1].(string)
+	if chunk != wantChunk {
+		t.Fatalf("expected chunk %q, got %q", wantChunk, chunk)
+	}
+}
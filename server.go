@@ -1,10 +1,13 @@
 package wango
 
 import (
+	"context"
 	"io"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/websocket"
@@ -17,12 +20,39 @@ type WS struct {
 	rpcHandlers       map[string]RPCHandler
 	rpcRgxHandlers    map[*regexp.Regexp]RPCHandler
 	subHandlers       map[string]subHandler
-	subscribers       map[string]subscribersMap
+	subscribers       map[string]*subscriptionEntry
 	subscribersLocker sync.RWMutex
 	openCB            func()
 	closeCB           func()
+	authenticator     Authenticator
+
+	rpcCtxHandlers    map[string]RPCHandlerCtx
+	rpcCtxRgxHandlers map[*regexp.Regexp]RPCHandlerCtx
+	inFlightCalls     map[string]context.CancelFunc
+	callConnections   map[string]*conn
+	inFlightLocker    sync.Mutex
+
+	sendTimeout    time.Duration
+	sendBufferSize int
+	slowConsumerCB SlowConsumerCB
+	metrics        *Metrics
 }
 
+// MatchMode controls how a subscribed URI is matched, both against a
+// registered subHandler's URI and against a published URI.
+type MatchMode int
+
+// Subscription match modes, mirroring WAMP's exact/prefix/wildcard policies.
+const (
+	// MatchExact requires the subscribed URI and the published URI to be equal.
+	MatchExact MatchMode = iota
+	// MatchPrefix matches when the subscribed URI is a prefix of the published URI.
+	MatchPrefix
+	// MatchWildcard matches dotted URI segments, where an empty pattern segment
+	// (e.g. "com.example..onevent") matches any single segment of the published URI.
+	MatchWildcard
+)
+
 // RPCHandler describes func for handling RPC requests
 type RPCHandler func(connID string, uri string, args ...interface{}) (interface{}, error)
 
@@ -35,14 +65,27 @@ type PubHandler func(uri string, event interface{}, extra interface{}) (bool, in
 type subHandler struct {
 	subHandler SubHandler
 	pubHandler PubHandler
+	match      MatchMode
 }
 type subscribersMap map[string]bool
 
+// subscriptionEntry is a single client subscription: the URI (or pattern, for
+// MatchPrefix/MatchWildcard) the client subscribed to, the match mode it was
+// accepted under, and the set of connections subscribed to it.
+type subscriptionEntry struct {
+	mode        MatchMode
+	subscribers subscribersMap
+}
+
 type conn struct {
-	id         string
-	connection *websocket.Conn
-	extra      interface{}
-	sendChan   chan interface{}
+	id            string
+	connection    Transport
+	extra         interface{}
+	sendChan      chan interface{}
+	server        *WS
+	dropped       int64
+	slowOnce      sync.Once
+	lastHeartbeat time.Time
 }
 
 // New creates new WS struct and returns pointer to it
@@ -52,7 +95,14 @@ func New() *WS {
 	server.rpcHandlers = map[string]RPCHandler{}
 	server.rpcRgxHandlers = map[*regexp.Regexp]RPCHandler{}
 	server.subHandlers = map[string]subHandler{}
-	server.subscribers = map[string]subscribersMap{}
+	server.subscribers = map[string]*subscriptionEntry{}
+	server.rpcCtxHandlers = map[string]RPCHandlerCtx{}
+	server.rpcCtxRgxHandlers = map[*regexp.Regexp]RPCHandlerCtx{}
+	server.inFlightCalls = map[string]context.CancelFunc{}
+	server.callConnections = map[string]*conn{}
+	server.sendTimeout = defaultSendTimeout
+	server.sendBufferSize = defaultSendBufferSize
+	server.metrics = newMetrics()
 	return server
 }
 
@@ -78,8 +128,16 @@ func (server *WS) RegisterRPCHandler(_uri interface{}, fn RPCHandler) error {
 	return nil
 }
 
-// RegisterSubHandler registers subscription handler function for provided URI
+// RegisterSubHandler registers subscription handler function for provided URI,
+// matching subscribed URIs by prefix, as it has always done.
 func (server *WS) RegisterSubHandler(uri string, fnSub SubHandler, fnPub PubHandler) error {
+	return server.RegisterSubHandlerWithMatch(uri, MatchPrefix, fnSub, fnPub)
+}
+
+// RegisterSubHandlerWithMatch registers a subscription handler function for
+// provided URI using the given MatchMode to decide which subscribed and
+// published URIs it applies to.
+func (server *WS) RegisterSubHandlerWithMatch(uri string, mode MatchMode, fnSub SubHandler, fnPub PubHandler) error {
 	if _, ok := server.subHandlers[uri]; ok {
 		return errors.Wrap(ErrHandlerAlreadyRegistered, "when registering subHandler")
 	}
@@ -87,41 +145,117 @@ func (server *WS) RegisterSubHandler(uri string, fnSub SubHandler, fnPub PubHand
 	server.subHandlers[uri] = subHandler{
 		subHandler: fnSub,
 		pubHandler: fnPub,
+		match:      mode,
 	}
 	return nil
 }
 
+// matchURI reports whether uri is matched by pattern under mode. It is used
+// both to decide whether a subscribe request falls under a registered
+// subHandler, and to decide whether a published URI reaches a subscription.
+func matchURI(pattern, uri string, mode MatchMode) bool {
+	switch mode {
+	case MatchExact:
+		return pattern == uri
+	case MatchWildcard:
+		return matchWildcard(pattern, uri)
+	default:
+		return strings.HasPrefix(uri, pattern)
+	}
+}
+
+// matchWildcard matches dotted URI segments, where an empty segment in
+// pattern (e.g. "com.example..onevent") matches any single segment of uri.
+func matchWildcard(pattern, uri string) bool {
+	patternParts := strings.Split(pattern, ".")
+	uriParts := strings.Split(uri, ".")
+	if len(patternParts) != len(uriParts) {
+		return false
+	}
+	for i, part := range patternParts {
+		if part != "" && part != uriParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PublishOptions controls which subscribers receive a published event,
+// mirroring the WAMP PUBLISH options dict.
+type PublishOptions struct {
+	// Exclude lists connection IDs that must not receive the event.
+	Exclude []string
+	// ExcludeMe excludes the publishing connection itself. It defaults to
+	// true when set via the wire-level PUBLISH handler, since a publisher
+	// rarely wants to receive its own event back.
+	ExcludeMe bool
+	// Eligible, if non-empty, restricts delivery to these connection IDs.
+	Eligible []string
+	// ExcludeAuthID excludes subscribers whose conn.extra reports one of
+	// these auth IDs via the authIdentified interface.
+	ExcludeAuthID []string
+	// EligibleAuthID, if non-empty, restricts delivery to subscribers whose
+	// conn.extra reports one of these auth IDs via the authIdentified interface.
+	EligibleAuthID []string
+}
+
+// authIdentified is implemented by values stored in conn.extra that carry an
+// authid, so PublishOptions.ExcludeAuthID/EligibleAuthID can filter on it.
+type authIdentified interface {
+	AuthID() string
+}
+
 // Publish used for publish event
 func (server *WS) Publish(uri string, event interface{}) {
+	server.PublishWithOptions(uri, event, PublishOptions{})
+}
+
+// PublishWithOptions publishes event to uri's subscribers, applying the
+// exclusion and eligibility rules in opts.
+func (server *WS) PublishWithOptions(uri string, event interface{}, opts PublishOptions) {
 	var pubHandler PubHandler
 	handler, ok := server.subHandlers[uri]
 	if ok {
 		pubHandler = handler.pubHandler
 	}
 	server.subscribersLocker.RLock()
-	subscribers, ok := server.subscribers[uri]
-	if !ok {
-		server.subscribersLocker.RUnlock()
-		return
+	// need to copy ids to prevent long locking; dedupe in case a connection
+	// matches more than one pattern for this uri
+	subscriberIdSet := map[string]bool{}
+	for pattern, entry := range server.subscribers {
+		if !matchURI(pattern, uri, entry.mode) {
+			continue
+		}
+		for id := range entry.subscribers {
+			subscriberIdSet[id] = true
+		}
 	}
-	if len(subscribers) == 0 {
-		server.subscribersLocker.RUnlock()
+	server.subscribersLocker.RUnlock()
+	if len(subscriberIdSet) == 0 {
 		return
 	}
-	// need to copy ids to prevent long locking
-	subscriberIds := make([]string, len(subscribers))
-	i := 0
-	for id := range subscribers {
-		subscriberIds[i] = id
-		i++
+
+	exclude := toSet(opts.Exclude)
+	var eligible map[string]bool
+	if len(opts.Eligible) > 0 {
+		eligible = toSet(opts.Eligible)
 	}
-	server.subscribersLocker.RUnlock()
-	for _, id := range subscriberIds {
+
+	for id := range subscriberIdSet {
+		if exclude[id] {
+			continue
+		}
+		if eligible != nil && !eligible[id] {
+			continue
+		}
 		c, err := server.getConnection(id)
 		if err != nil {
 			println("Connection not found", err)
 			continue
 		}
+		if !authIDEligible(c.extra, opts) {
+			continue
+		}
 
 		var response []byte
 		if pubHandler != nil {
@@ -138,12 +272,65 @@ func (server *WS) Publish(uri string, event interface{}) {
 	}
 }
 
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// authIDEligible reports whether extra (a conn's or Session's extra value)
+// passes opts' exclude_authid/eligible_authid filters. Values that don't
+// carry an auth ID pass exclusion checks but fail an eligible_authid
+// allow-list.
+func authIDEligible(extra interface{}, opts PublishOptions) bool {
+	if len(opts.ExcludeAuthID) == 0 && len(opts.EligibleAuthID) == 0 {
+		return true
+	}
+	ai, ok := extra.(authIdentified)
+	if !ok {
+		return len(opts.EligibleAuthID) == 0
+	}
+	authID := ai.AuthID()
+	for _, excluded := range opts.ExcludeAuthID {
+		if excluded == authID {
+			return false
+		}
+	}
+	if len(opts.EligibleAuthID) == 0 {
+		return true
+	}
+	for _, eligible := range opts.EligibleAuthID {
+		if eligible == authID {
+			return true
+		}
+	}
+	return false
+}
+
 // WampHandler handles every *websocket.Conn connection
 // If extra data provided, it will kept in connection and will pass to rpc/pub/sub handlers
 func (server *WS) WampHandler(ws *websocket.Conn, extra interface{}) {
-	c := server.addConnection(ws, extra)
+	server.WampHandlerTransport(NewXNetWebsocketTransport(ws), extra)
+}
+
+// WampHandlerTransport handles a connection over any Transport, letting
+// wango be mounted on gorilla/websocket or WAMP RawSocket in addition to the
+// default golang.org/x/net/websocket transport used by WampHandler.
+// If extra data provided, it will kept in connection and will pass to rpc/pub/sub handlers
+func (server *WS) WampHandlerTransport(t Transport, extra interface{}) {
+	c := server.addConnection(t, extra)
 	defer server.deleteConnection(c.id)
 
+	if server.authenticator != nil {
+		authExtra, ok := server.authenticate(c)
+		if !ok {
+			return
+		}
+		c.extra = authExtra
+	}
+
 	go c.sender()
 
 	server.receive(c)
@@ -151,9 +338,8 @@ func (server *WS) WampHandler(ws *websocket.Conn, extra interface{}) {
 
 func (server *WS) receive(c *conn) {
 	defer c.connection.Close()
-	var data string
 	for {
-		err := websocket.Message.Receive(c.connection, &data)
+		data, err := c.connection.Receive()
 		if err != nil {
 			if err != io.EOF {
 				// Error receiving message
@@ -165,6 +351,9 @@ func (server *WS) receive(c *conn) {
 			// error parsing!!!
 			println("Error:", err.Error())
 		}
+		if err == nil {
+			atomic.AddInt64(&server.metrics.messagesReceived, 1)
+		}
 		switch msgType {
 		case msgPrefix:
 		// not implemented
@@ -183,6 +372,8 @@ func (server *WS) receive(c *conn) {
 		// not implemented
 		case msgHeartbeat:
 			server.handleHeartbeat(c, msg, data)
+		case msgCancel:
+			server.handleCancel(c, msg)
 		}
 	}
 }
@@ -195,6 +386,11 @@ func (server *WS) handleRPCCall(c *conn, msg []interface{}) {
 	}
 
 	uri := rpcMessage.URI
+	if ctxHandler, ok := server.lookupRPCHandlerCtx(uri); ok {
+		server.callRPCHandlerCtx(c, rpcMessage.CallID, uri, ctxHandler, rpcMessage.Args)
+		return
+	}
+
 	handler, ok := server.rpcHandlers[uri]
 	if !ok {
 		var rgx *regexp.Regexp
@@ -207,8 +403,10 @@ func (server *WS) handleRPCCall(c *conn, msg []interface{}) {
 	}
 
 	if ok {
+		atomic.AddInt64(&server.metrics.rpcCalls, 1)
 		res, err := handler(c.id, uri, rpcMessage.Args...)
 		if err != nil {
+			atomic.AddInt64(&server.metrics.rpcErrors, 1)
 			response, _ := createMessage(msgCallError, rpcMessage.CallID, createError(err))
 			// TODO: error handling
 			c.send(response)
@@ -234,12 +432,15 @@ func (server *WS) handleSubscribe(c *conn, msg []interface{}) {
 	server.subscribersLocker.Lock()
 	defer server.subscribersLocker.Unlock()
 	for uri, handler := range server.subHandlers {
-		if strings.HasPrefix(_uri, uri) {
+		if matchURI(uri, _uri, handler.match) {
 			if handler.subHandler(c.id, _uri, subMessage.Args...) {
-				if _, ok := server.subscribers[_uri]; !ok {
-					server.subscribers[_uri] = subscribersMap{}
+				entry, ok := server.subscribers[_uri]
+				if !ok {
+					entry = &subscriptionEntry{mode: handler.match, subscribers: subscribersMap{}}
+					server.subscribers[_uri] = entry
 				}
-				server.subscribers[_uri][c.id] = subscriberExists
+				entry.subscribers[c.id] = subscriberExists
+				server.metrics.setSubscriptionCount(_uri, len(entry.subscribers))
 				response, _ := createMessage(msgSubscribed, _uri)
 				go c.send(response)
 				return
@@ -263,24 +464,29 @@ func (server *WS) handleUnSubscribe(c *conn, msg []interface{}) {
 	_uri := unsubMessage.URI
 	server.subscribersLocker.Lock()
 	defer server.subscribersLocker.Unlock()
-	for uri, subscribers := range server.subscribers {
-		if uri == _uri {
-			if _, ok := subscribers[c.id]; ok {
-				delete(subscribers, c.id)
-				response, _ := createMessage(msgUnsubscribed, _uri)
-				go c.send(response)
-				return
-			}
-			response, _ := createMessage(msgUnSubscribeError, _uri, createError(ErrNotSubscribes))
-			go c.send(response)
-			return
-		}
+	entry, ok := server.subscribers[_uri]
+	if !ok {
+		response, _ := createMessage(msgUnSubscribeError, _uri, createError(ErrSubURINotRegistered))
+		go c.send(response)
+		return
+	}
+	if _, ok := entry.subscribers[c.id]; !ok {
+		response, _ := createMessage(msgUnSubscribeError, _uri, createError(ErrNotSubscribes))
+		go c.send(response)
+		return
 	}
-	response, _ := createMessage(msgUnSubscribeError, _uri, createError(ErrSubURINotRegistered))
+	delete(entry.subscribers, c.id)
+	server.metrics.setSubscriptionCount(_uri, len(entry.subscribers))
+	response, _ := createMessage(msgUnsubscribed, _uri)
 	go c.send(response)
 }
 
 func (server *WS) handleHeartbeat(c *conn, msg []interface{}, data string) {
+	now := time.Now()
+	if !c.lastHeartbeat.IsZero() {
+		server.metrics.recordHeartbeat(now.Sub(c.lastHeartbeat))
+	}
+	c.lastHeartbeat = now
 	c.send(data)
 }
 
@@ -294,18 +500,59 @@ func (server *WS) handlePublish(c *conn, msg []interface{}) {
 	if len(pubMessage.Args) > 0 {
 		event = pubMessage.Args[0]
 	}
-	server.Publish(pubMessage.URI, event)
+	var rawOptions map[string]interface{}
+	if len(pubMessage.Args) > 1 {
+		rawOptions, _ = pubMessage.Args[1].(map[string]interface{})
+	}
+	opts := parsePublishOptions(rawOptions)
+	if opts.ExcludeMe {
+		opts.Exclude = append(opts.Exclude, c.id)
+	}
+	server.PublishWithOptions(pubMessage.URI, event, opts)
 }
 
-func (server *WS) addConnection(ws *websocket.Conn, extra interface{}) *conn {
+// parsePublishOptions parses the wire-level PUBLISH options argument into a
+// PublishOptions. exclude_me defaults to true, as WAMP specifies.
+func parsePublishOptions(raw map[string]interface{}) PublishOptions {
+	opts := PublishOptions{ExcludeMe: true}
+	if raw == nil {
+		return opts
+	}
+	if v, ok := raw["exclude_me"].(bool); ok {
+		opts.ExcludeMe = v
+	}
+	opts.Exclude = toStringSlice(raw["exclude"])
+	opts.Eligible = toStringSlice(raw["eligible"])
+	opts.ExcludeAuthID = toStringSlice(raw["exclude_authid"])
+	opts.EligibleAuthID = toStringSlice(raw["eligible_authid"])
+	return opts
+}
+
+func toStringSlice(v interface{}) []string {
+	raw, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	out := make([]string, 0, len(raw))
+	for _, item := range raw {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (server *WS) addConnection(t Transport, extra interface{}) *conn {
 	cn := new(conn)
-	cn.connection = ws
+	cn.connection = t
 	cn.id = newUUIDv4()
 	cn.extra = extra
-	cn.sendChan = make(chan interface{}, sendChanBufferSize)
+	cn.server = server
+	cn.sendChan = make(chan interface{}, server.sendBufferSize)
 	server.connectionsLocker.Lock()
 	defer server.connectionsLocker.Unlock()
 	server.connections[cn.id] = cn
+	atomic.AddInt64(&server.metrics.openConnections, 1)
 
 	return cn
 }
@@ -326,21 +573,67 @@ func (server *WS) deleteConnection(id string) {
 	defer server.connectionsLocker.Unlock()
 	server.subscribersLocker.Lock()
 	defer server.subscribersLocker.Unlock()
+	if _, ok := server.connections[id]; ok {
+		atomic.AddInt64(&server.metrics.openConnections, -1)
+	}
 	delete(server.connections, id)
-	for _, subscribers := range server.subscribers {
-		delete(subscribers, id)
+	for uri, entry := range server.subscribers {
+		if _, ok := entry.subscribers[id]; ok {
+			delete(entry.subscribers, id)
+			server.metrics.setSubscriptionCount(uri, len(entry.subscribers))
+		}
 	}
+
+	server.inFlightLocker.Lock()
+	prefix := id + ":"
+	for key, cancel := range server.inFlightCalls {
+		if strings.HasPrefix(key, prefix) {
+			cancel()
+		}
+	}
+	server.inFlightLocker.Unlock()
 }
 
+// send queues msg for delivery, non-blocking up to the server's configured
+// send timeout. A consumer that still can't keep up within that window is
+// treated as a slow consumer: it is disconnected and SlowConsumerCB, if
+// set, is notified.
 func (c *conn) send(msg interface{}) {
-	c.sendChan <- msg
+	select {
+	case c.sendChan <- msg:
+		return
+	case <-time.After(c.server.sendTimeout):
+	}
+	c.handleSlowConsumer()
+}
+
+func (c *conn) handleSlowConsumer() {
+	dropped := atomic.AddInt64(&c.dropped, 1)
+	atomic.AddInt64(&c.server.metrics.messagesDropped, 1)
+	c.slowOnce.Do(func() {
+		if c.server.slowConsumerCB != nil {
+			c.server.slowConsumerCB(c.id, int(dropped))
+		}
+		c.connection.Close()
+	})
 }
 
 func (c *conn) sender() {
 	for msg := range c.sendChan {
-		err := websocket.Message.Send(c.connection, msg)
-		if err != nil {
+		var data string
+		switch v := msg.(type) {
+		case string:
+			data = v
+		case []byte:
+			data = string(v)
+		default:
+			println("Error when send message: unsupported message type")
+			continue
+		}
+		if err := c.connection.Send(data); err != nil {
 			println("Error when send message", err)
+			continue
 		}
+		atomic.AddInt64(&c.server.metrics.messagesSent, 1)
 	}
 }
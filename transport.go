@@ -0,0 +1,127 @@
+package wango
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	gorillaws "github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// rawSocketMaxFrameSize bounds a single RawSocket frame to guard against a
+// malformed or malicious length prefix forcing an unbounded allocation.
+const rawSocketMaxFrameSize = 16 * 1024 * 1024
+
+// ErrRawSocketFrameTooLarge is returned when a RawSocket peer advertises a
+// frame length above rawSocketMaxFrameSize.
+var ErrRawSocketFrameTooLarge = errors.New("rawsocket frame too large")
+
+// Transport abstracts the wire connection a conn reads frames from and
+// writes frames to, so WS is no longer hardcoded to golang.org/x/net/websocket.
+// Send/Receive deal in whole WAMP text frames; Receive returns io.EOF (or any
+// other error) when the underlying connection is gone.
+type Transport interface {
+	Send(msg string) error
+	Receive() (string, error)
+	Close() error
+}
+
+// xnetWebsocketTransport adapts golang.org/x/net/websocket.Conn, the
+// transport WS has always used, to the Transport interface.
+type xnetWebsocketTransport struct {
+	conn *websocket.Conn
+}
+
+// NewXNetWebsocketTransport wraps an established golang.org/x/net/websocket
+// connection as a Transport.
+func NewXNetWebsocketTransport(conn *websocket.Conn) Transport {
+	return &xnetWebsocketTransport{conn: conn}
+}
+
+func (t *xnetWebsocketTransport) Send(msg string) error {
+	return websocket.Message.Send(t.conn, msg)
+}
+
+func (t *xnetWebsocketTransport) Receive() (string, error) {
+	var data string
+	err := websocket.Message.Receive(t.conn, &data)
+	return data, err
+}
+
+func (t *xnetWebsocketTransport) Close() error {
+	return t.conn.Close()
+}
+
+// gorillaWebsocketTransport adapts github.com/gorilla/websocket.Conn, which
+// supports subprotocol negotiation, ping/pong and larger message limits than
+// x/net/websocket, so wango can be mounted behind gorilla/mux routers.
+type gorillaWebsocketTransport struct {
+	conn *gorillaws.Conn
+}
+
+// NewGorillaWebsocketTransport wraps an established gorilla/websocket
+// connection as a Transport.
+func NewGorillaWebsocketTransport(conn *gorillaws.Conn) Transport {
+	return &gorillaWebsocketTransport{conn: conn}
+}
+
+func (t *gorillaWebsocketTransport) Send(msg string) error {
+	return t.conn.WriteMessage(gorillaws.TextMessage, []byte(msg))
+}
+
+func (t *gorillaWebsocketTransport) Receive() (string, error) {
+	_, data, err := t.conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (t *gorillaWebsocketTransport) Close() error {
+	return t.conn.Close()
+}
+
+// rawSocketTransport implements the WAMP RawSocket transport: plain TCP
+// framed with a 4-byte big-endian length prefix per message, used by
+// non-browser clients that skip the WebSocket upgrade entirely.
+type rawSocketTransport struct {
+	conn net.Conn
+}
+
+// NewRawSocketTransport wraps an established TCP connection as a
+// length-prefixed RawSocket Transport.
+func NewRawSocketTransport(conn net.Conn) Transport {
+	return &rawSocketTransport{conn: conn}
+}
+
+func (t *rawSocketTransport) Send(msg string) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(msg)))
+	if _, err := t.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := t.conn.Write([]byte(msg))
+	return err
+}
+
+func (t *rawSocketTransport) Receive() (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(t.conn, header); err != nil {
+		return "", err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > rawSocketMaxFrameSize {
+		return "", ErrRawSocketFrameTooLarge
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(t.conn, body); err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (t *rawSocketTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,56 @@
+package wango
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestRawSocketTransportRoundTrip(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	serverTransport := NewRawSocketTransport(server)
+	clientTransport := NewRawSocketTransport(client)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serverTransport.Send("hello")
+	}()
+
+	got, err := clientTransport.Receive()
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", got)
+	}
+}
+
+func TestRawSocketTransportRejectsOversizedFrame(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	clientTransport := NewRawSocketTransport(client)
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, rawSocketMaxFrameSize+1)
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Write(header)
+		done <- err
+	}()
+
+	_, err := clientTransport.Receive()
+	if err != ErrRawSocketFrameTooLarge {
+		t.Fatalf("expected ErrRawSocketFrameTooLarge, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("writing oversized header: %v", err)
+	}
+}